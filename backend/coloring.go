@@ -0,0 +1,47 @@
+package main
+
+import "math"
+
+// colorValueFor converts a raw IterationResult into the value handed to
+// Palette.Color, according to the requested coloring mode:
+//
+//   - "escape" (the default): the plain integer iteration count, which
+//     bands visibly where the escape count changes by one.
+//   - "smooth": the normalized iteration count, n + 1 - log(log|z|)/log(2),
+//     which removes that banding by using the escape modulus to interpolate
+//     between iteration n and n+1.
+//   - "distance": the distance-estimator value |z|*log|z| / |z'|, using the
+//     derivative tracked alongside the main iteration to resolve boundary
+//     detail escape/smooth coloring can't reach. It's rescaled onto the
+//     same 0..maxIter range Palette.Color expects so existing palettes
+//     still look sensible in DE mode.
+func colorValueFor(coloring string, res IterationResult, maxIter int) float64 {
+	if !res.escaped {
+		return float64(maxIter)
+	}
+	switch coloring {
+	case "smooth":
+		logZn := math.Log(res.modulus) / 2
+		nu := math.Log(logZn) / math.Log(2)
+		return clamp(float64(res.iters)+1-nu, 0, float64(maxIter-1))
+	case "distance":
+		if res.dzModulus == 0 {
+			return float64(res.iters)
+		}
+		z := math.Sqrt(res.modulus)
+		distance := z * math.Log(z) / res.dzModulus
+		return clamp(float64(maxIter)*(1-distance), 0, float64(maxIter-1))
+	default: // "escape"
+		return float64(res.iters)
+	}
+}
+
+func clamp(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
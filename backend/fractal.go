@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"image/color"
 	"log"
 	"math"
 	"strconv"
 	"sync"
+	"time"
 )
 
+// deadlineSafetyMargin is how far ahead of the Lambda invocation deadline
+// generateFractalBytes stops collecting pixels, leaving enough time to
+// encode and return whatever was rendered before the container is killed.
+const deadlineSafetyMargin = 500 * time.Millisecond
+
 type Pix struct {
 	x  int
 	y  int
@@ -23,50 +31,102 @@ type WorkItem struct {
 }
 
 type Config struct {
-	posX       float64
-	posY       float64
-	height     float64
-	imgWidth   int
-	imgHeight  int
-	pixelTotal int
-	maxIter    int
-	samples    int
-	numBlocks  int
-	numThreads int
-	ratio      float64
+	posX              float64
+	posY              float64
+	posXRaw           string
+	posYRaw           string
+	height            float64
+	imgWidth          int
+	imgHeight         int
+	pixelTotal        int
+	maxIter           int
+	minSamples        int
+	maxSamples        int
+	varianceEpsilon   float64
+	numBlocks         int
+	numThreads        int
+	ratio             float64
+	format            string
+	quality           int
+	xComponents       int
+	yComponents       int
+	thumbMaxDim       int
+	renderer          string
+	refPointPrecision int
+	glitchEpsilon     float64
+	palette           string
+	paletteStops      string
+	coloring          string
+	sentinelR         uint8
+	sentinelG         uint8
+	sentinelB         uint8
 }
 
 // newConfigFromRequest parses the HTTP request to create a Config.
 // newConfigFromRequest now accepts a map from the API Gateway event.
 func newConfigFromRequest(params map[string]string) Config {
 	cfg := Config{
-		posX:       getFloatParam(params, "posX", -2.0),
-		posY:       getFloatParam(params, "posY", -1.2),
-		height:     getFloatParam(params, "height", 2.5),
-		imgWidth:   getIntParam(params, "width", 1024),
-		imgHeight:  getIntParam(params, "height_px", 1024),
-		maxIter:    getIntParam(params, "maxIter", 1000),
-		samples:    getIntParam(params, "samples", 50),
-		numBlocks:  getIntParam(params, "numBlocks", 64),
-		numThreads: getIntParam(params, "numThreads", 16),
+		posX:              getFloatParam(params, "posX", -2.0),
+		posY:              getFloatParam(params, "posY", -1.2),
+		posXRaw:           getStringParam(params, "posX", "-2.0"),
+		posYRaw:           getStringParam(params, "posY", "-1.2"),
+		height:            getFloatParam(params, "height", 2.5),
+		imgWidth:          getIntParam(params, "width", 1024),
+		imgHeight:         getIntParam(params, "height_px", 1024),
+		maxIter:           getIntParam(params, "maxIter", 1000),
+		minSamples:        getIntParam(params, "minSamples", 4),
+		maxSamples:        getIntParam(params, "maxSamples", getIntParam(params, "samples", 50)),
+		varianceEpsilon:   getFloatParam(params, "varianceEpsilon", 25),
+		numBlocks:         getIntParam(params, "numBlocks", 64),
+		numThreads:        getIntParam(params, "numThreads", 16),
+		format:            getStringParam(params, "format", "raw"),
+		quality:           getIntParam(params, "quality", 90),
+		xComponents:       getIntParam(params, "xComponents", 4),
+		yComponents:       getIntParam(params, "yComponents", 3),
+		thumbMaxDim:       getIntParam(params, "thumbMaxDim", 64),
+		renderer:          getStringParam(params, "renderer", ""),
+		refPointPrecision: getIntParam(params, "refPointPrecision", 256),
+		glitchEpsilon:     getFloatParam(params, "glitchEpsilon", 1e-3),
+		palette:           getStringParam(params, "palette", "wikipedia"),
+		paletteStops:      getStringParam(params, "stops", ""),
+		coloring:          getStringParam(params, "coloring", "escape"),
 	}
 	cfg.pixelTotal = cfg.imgWidth * cfg.imgHeight
 	cfg.ratio = float64(cfg.imgWidth) / float64(cfg.imgHeight)
+	if getIntParam(params, "blurhash", 0) != 0 && cfg.format == "raw" {
+		cfg.format = "blurhash"
+	}
+	sentinel, err := parseHexColor(getStringParam(params, "sentinelColor", "000000"))
+	if err != nil {
+		sentinel = color.RGBA{}
+	}
+	cfg.sentinelR, cfg.sentinelG, cfg.sentinelB = sentinel.R, sentinel.G, sentinel.B
 	return cfg
 }
 
-// generateFractalBytes is the main logic function, now returning a byte slice.
-func generateFractalBytes(cfg Config) ([]byte, error) {
-	// Create a flat byte slice to hold RGBA values for every pixel.
+// generateFractalBytes is the main logic function. It returns the encoded
+// image bytes, the Content-Type the caller should send, and whether every
+// pixel finished rendering. cfg.format of "raw" (the default) preserves the
+// original flat-RGBA behavior. ctx's deadline (if any) is respected: pixel
+// collection stops deadlineSafetyMargin before it and any pixels left
+// unrendered are filled with the caller's sentinel color rather than
+// blocking until Lambda kills the container.
+func generateFractalBytes(ctx context.Context, cfg Config) ([]byte, string, bool, error) {
+	// Create a flat byte slice to hold RGBA values for every pixel, and
+	// pre-fill it with the sentinel color in case the deadline cuts
+	// collection short before every pixel arrives.
 	pixels := make([]byte, cfg.imgWidth*cfg.imgHeight*4)
+	fillSentinel(pixels, cfg.sentinelR, cfg.sentinelG, cfg.sentinelB)
 
 	workBuffer := make(chan WorkItem, cfg.numBlocks)
 	pixelBuffer := make(chan Pix, cfg.pixelTotal)
 	var wg sync.WaitGroup
 
+	palette := paletteForConfig(&cfg)
+
 	wg.Add(cfg.numThreads)
 	for i := 0; i < cfg.numThreads; i++ {
-		go workerThread(&cfg, &wg, workBuffer, pixelBuffer)
+		go workerThread(ctx, &cfg, palette, &wg, workBuffer, pixelBuffer)
 	}
 
 	go func() {
@@ -79,40 +139,91 @@ func generateFractalBytes(cfg Config) ([]byte, error) {
 		close(pixelBuffer)
 	}()
 
-	// Collect results and place them directly into the byte slice.
-	for p := range pixelBuffer {
-		// Calculate the starting index for this pixel in the flat slice.
-		idx := (p.y*cfg.imgWidth + p.x) * 4
-		pixels[idx] = p.cr   // R
-		pixels[idx+1] = p.cg // G
-		pixels[idx+2] = p.cb // B
-		pixels[idx+3] = 255  // A (fully opaque)
+	var deadlineCh <-chan time.Time
+	if deadline, ok := ctx.Deadline(); ok {
+		timer := time.NewTimer(time.Until(deadline.Add(-deadlineSafetyMargin)))
+		defer timer.Stop()
+		deadlineCh = timer.C
+	}
+
+	// Collect results and place them directly into the byte slice, stopping
+	// early (and reporting an incomplete render) if the Lambda deadline is
+	// about to hit rather than racing the container getting killed.
+	complete := true
+collect:
+	for {
+		select {
+		case p, ok := <-pixelBuffer:
+			if !ok {
+				break collect
+			}
+			idx := (p.y*cfg.imgWidth + p.x) * 4
+			pixels[idx] = p.cr   // R
+			pixels[idx+1] = p.cg // G
+			pixels[idx+2] = p.cb // B
+			pixels[idx+3] = 255  // A (fully opaque)
+		case <-deadlineCh:
+			log.Println("Deadline approaching; returning partial render.")
+			complete = false
+			break collect
+		}
 	}
 
 	log.Println("Finished pixel calculation.")
-	return pixels, nil
+	switch cfg.format {
+	case "blurhash":
+		bytesOut, contentType, err := encodeBlurhashPlaceholder(pixels, cfg.imgWidth, cfg.imgHeight, cfg.xComponents, cfg.yComponents)
+		return bytesOut, contentType, complete, err
+	case "thumbnail":
+		bytesOut, contentType, err := encodeThumbnail(pixels, cfg.imgWidth, cfg.imgHeight, cfg.thumbMaxDim)
+		return bytesOut, contentType, complete, err
+	default:
+		bytesOut, contentType, err := encodeFractalImage(pixels, cfg.imgWidth, cfg.imgHeight, cfg.format, cfg.quality)
+		return bytesOut, contentType, complete, err
+	}
+}
+
+// fillSentinel paints every pixel in a flat RGBA buffer with the same
+// opaque color, used to seed un-rendered pixels before a possibly-partial
+// render so a timed-out request still returns a complete image buffer.
+func fillSentinel(pixels []byte, r, g, b uint8) {
+	for i := 0; i+3 < len(pixels); i += 4 {
+		pixels[i] = r
+		pixels[i+1] = g
+		pixels[i+2] = b
+		pixels[i+3] = 255
+	}
 }
 
-func workerThread(cfg *Config, wg *sync.WaitGroup, workBuffer <-chan WorkItem, pixelBuffer chan<- Pix) {
+func workerThread(ctx context.Context, cfg *Config, palette Palette, wg *sync.WaitGroup, workBuffer <-chan WorkItem, pixelBuffer chan<- Pix) {
 	defer wg.Done()
-	for workItem := range workBuffer {
+	perturb := usePerturbation(cfg)
+	for {
+		var workItem WorkItem
+		select {
+		case <-ctx.Done():
+			return
+		case wi, ok := <-workBuffer:
+			if !ok {
+				return
+			}
+			workItem = wi
+		}
+
+		// Deep zooms need a reference orbit computed once per work block
+		// (not per pixel) in high precision; everything else keeps using
+		// the plain float64 iteration below.
+		var pool *refOrbitPool
+		if perturb {
+			centerFX := float64(workItem.initialX+workItem.finalX) / 2
+			centerFY := float64(workItem.initialY+workItem.finalY) / 2
+			pool = newRefOrbitPool(cfg, centerFX, centerFY)
+		}
+
 		for x := workItem.initialX; x < workItem.finalX; x++ {
 			for y := workItem.initialY; y < workItem.finalY; y++ {
-				var colorR, colorG, colorB int
-				for k := 0; k < cfg.samples; k++ {
-					a := cfg.height*cfg.ratio*((float64(x)+RandFloat64())/float64(cfg.imgWidth)) + cfg.posX
-					b := cfg.height*((float64(y)+RandFloat64())/float64(cfg.imgHeight)) + cfg.posY
-					c := pixelColor(mandelbrotIteraction(a, b, cfg.maxIter))
-					colorR += int(c.R)
-					colorG += int(c.G)
-					colorB += int(c.B)
-				}
-				pixelBuffer <- Pix{
-					x, y,
-					uint8(float64(colorR) / float64(cfg.samples)),
-					uint8(float64(colorG) / float64(cfg.samples)),
-					uint8(float64(colorB) / float64(cfg.samples)),
-				}
+				r, g, b := adaptiveSamplePixel(cfg, palette, perturb, pool, x, y)
+				pixelBuffer <- Pix{x, y, r, g, b}
 			}
 		}
 	}
@@ -132,17 +243,31 @@ func workBufferInit(cfg *Config, workBuffer chan WorkItem) {
 	}
 }
 
-func mandelbrotIteraction(a, b float64, maxIter int) (float64, int) {
+// IterationResult carries the state coloring modes need beyond the plain
+// integer escape count: the escape modulus |z|^2 for smooth coloring and
+// the derivative modulus |z'| for the distance estimator (see coloring.go).
+type IterationResult struct {
+	modulus   float64
+	dzModulus float64
+	iters     int
+	escaped   bool
+}
+
+func mandelbrotIteraction(a, b float64, maxIter int) IterationResult {
 	var x, y, xx, yy, xy float64
+	var dzx, dzy float64 = 1, 0
 	for i := 0; i < maxIter; i++ {
 		xx, yy, xy = x*x, y*y, x*y
 		if xx+yy > 4 {
-			return xx + yy, i
+			return IterationResult{modulus: xx + yy, dzModulus: math.Hypot(dzx, dzy), iters: i, escaped: true}
 		}
+		// Track the derivative z'_{n+1} = 2*z_n*z'_n + 1 alongside the main
+		// iteration for the distance-estimator coloring mode.
+		dzx, dzy = 2*(x*dzx-y*dzy)+1, 2*(x*dzy+y*dzx)
 		x = xx - yy + a
 		y = 2*xy + b
 	}
-	return xx + yy, maxIter
+	return IterationResult{modulus: xx + yy, dzModulus: math.Hypot(dzx, dzy), iters: maxIter, escaped: false}
 }
 
 // Param helper functions accept a map[string]string.
@@ -158,6 +283,14 @@ func getIntParam(params map[string]string, name string, defaultValue int) int {
 	return val
 }
 
+func getStringParam(params map[string]string, name string, defaultValue string) string {
+	valStr, ok := params[name]
+	if !ok || valStr == "" {
+		return defaultValue
+	}
+	return valStr
+}
+
 func getFloatParam(params map[string]string, name string, defaultValue float64) float64 {
 	valStr, ok := params[name]
 	if !ok {
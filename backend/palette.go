@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Palette maps a (possibly fractional) color value to an RGBA color. The
+// scale of that value depends on the active coloring mode (escape/smooth/
+// distance, see colorValueFor), but it always runs from 0 up to maxIter.
+type Palette interface {
+	Color(iters float64, maxIter int) color.RGBA
+}
+
+// paletteCycle is how many iterations one full pass through a palette's
+// gradient stops covers, so palettes keep cycling through color bands on
+// deep zooms instead of flattening into a single color.
+const paletteCycle = 32
+
+type gradientStop struct {
+	at float64
+	c  color.RGBA
+}
+
+// gradientPalette implements Palette by linearly interpolating between an
+// ordered list of stops, wrapping every paletteCycle iterations.
+type gradientPalette struct {
+	stops []gradientStop
+}
+
+func (p *gradientPalette) Color(iters float64, maxIter int) color.RGBA {
+	if iters >= float64(maxIter) {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	t := math.Mod(iters/paletteCycle, 1)
+	return p.sample(t)
+}
+
+func (p *gradientPalette) sample(t float64) color.RGBA {
+	stops := p.stops
+	if t <= stops[0].at {
+		return stops[0].c
+	}
+	last := stops[len(stops)-1]
+	if t >= last.at {
+		return last.c
+	}
+	for i := 1; i < len(stops); i++ {
+		if t <= stops[i].at {
+			prev := stops[i-1]
+			frac := 0.0
+			if span := stops[i].at - prev.at; span > 0 {
+				frac = (t - prev.at) / span
+			}
+			return lerpRGBA(prev.c, stops[i].c, frac)
+		}
+	}
+	return last.c
+}
+
+func lerpRGBA(a, b color.RGBA, t float64) color.RGBA {
+	return color.RGBA{
+		R: lerpByte(a.R, b.R, t),
+		G: lerpByte(a.G, b.G, t),
+		B: lerpByte(a.B, b.B, t),
+		A: 255,
+	}
+}
+
+func lerpByte(a, b uint8, t float64) uint8 {
+	return uint8(float64(a) + (float64(b)-float64(a))*t)
+}
+
+var paletteRegistry = map[string]Palette{
+	"grayscale": &gradientPalette{stops: []gradientStop{
+		{0.0, color.RGBA{0, 0, 0, 255}},
+		{1.0, color.RGBA{255, 255, 255, 255}},
+	}},
+	"wikipedia": &gradientPalette{stops: []gradientStop{
+		{0.0, color.RGBA{0, 7, 100, 255}},
+		{0.16, color.RGBA{32, 107, 203, 255}},
+		{0.42, color.RGBA{237, 255, 255, 255}},
+		{0.6425, color.RGBA{255, 170, 0, 255}},
+		{0.8575, color.RGBA{0, 2, 0, 255}},
+		{1.0, color.RGBA{0, 7, 100, 255}},
+	}},
+	"ultra": &gradientPalette{stops: []gradientStop{
+		{0.0, color.RGBA{0, 0, 30, 255}},
+		{0.3, color.RGBA{150, 0, 200, 255}},
+		{0.6, color.RGBA{255, 120, 0, 255}},
+		{1.0, color.RGBA{255, 255, 200, 255}},
+	}},
+	"fire": &gradientPalette{stops: []gradientStop{
+		{0.0, color.RGBA{20, 0, 0, 255}},
+		{0.4, color.RGBA{200, 30, 0, 255}},
+		{0.8, color.RGBA{255, 180, 0, 255}},
+		{1.0, color.RGBA{255, 255, 200, 255}},
+	}},
+}
+
+// paletteForConfig resolves cfg.palette to a Palette, parsing
+// palette=custom&stops=0.0:ff0000,0.5:00ff00,1.0:0000ff gradients inline
+// since those carry per-request state and can't live in the static
+// registry.
+func paletteForConfig(cfg *Config) Palette {
+	if cfg.palette == "custom" {
+		return parseGradientStops(cfg.paletteStops)
+	}
+	if p, ok := paletteRegistry[cfg.palette]; ok {
+		return p
+	}
+	return paletteRegistry["wikipedia"]
+}
+
+// parseGradientStops parses "at:RRGGBB,at:RRGGBB,..." into a
+// gradientPalette, falling back to a plain black-to-white gradient if spec
+// doesn't contain at least two well-formed stops.
+func parseGradientStops(spec string) *gradientPalette {
+	var stops []gradientStop
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		at, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		c, err := parseHexColor(fields[1])
+		if err != nil {
+			continue
+		}
+		stops = append(stops, gradientStop{at: at, c: c})
+	}
+	if len(stops) < 2 {
+		return &gradientPalette{stops: []gradientStop{
+			{0.0, color.RGBA{0, 0, 0, 255}},
+			{1.0, color.RGBA{255, 255, 255, 255}},
+		}}
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].at < stops[j].at })
+	return &gradientPalette{stops: stops}
+}
+
+func parseHexColor(hex string) (color.RGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid hex color %q", hex)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{
+		R: uint8(v >> 16),
+		G: uint8(v >> 8),
+		B: uint8(v),
+		A: 255,
+	}, nil
+}
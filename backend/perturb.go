@@ -0,0 +1,220 @@
+package main
+
+import (
+	"math"
+	"math/big"
+)
+
+// perturbHeightThreshold is the zoom height below which float64 iteration
+// degrades into pixelated garbage and the perturbation-theory renderer
+// kicks in automatically.
+const perturbHeightThreshold = 1e-13
+
+// usePerturbation decides whether a request should render with the
+// high-precision perturbation-theory path instead of the plain float64
+// mandelbrotIteraction, either because the caller asked for it explicitly
+// (renderer=perturb) or because the zoom has outrun float64 precision.
+func usePerturbation(cfg *Config) bool {
+	return cfg.renderer == "perturb" || cfg.height < perturbHeightThreshold
+}
+
+// referenceOrbit is a single high-precision reference point c0, iterated to
+// maxIter (or escape) in big.Float arithmetic and recorded at float64
+// precision as Z_n for the per-pixel delta iteration below. centerFX/centerFY
+// are c0's location in pixel-grid coordinates (fractional pixel index, not
+// complex-plane position) so that later pixels can derive their dc from a
+// plain, precision-safe grid offset instead of subtracting two absolute
+// coordinates that were each already rounded to float64.
+type referenceOrbit struct {
+	centerFX, centerFY float64
+	z                  []complex128
+	escapedAt          int
+}
+
+// computeReferenceOrbit iterates c0 = cx + cy*i in big.Float arithmetic at
+// precisionBits of precision and records the orbit Z_n at float64
+// precision, which is all perturbIterate needs for the delta iteration. cx
+// and cy must already carry full precision (see referenceCenter) — deep
+// zooms need more significant digits than a float64 argument could hold.
+func computeReferenceOrbit(cx, cy *big.Float, centerFX, centerFY float64, maxIter int, precisionBits uint) referenceOrbit {
+	if precisionBits == 0 {
+		precisionBits = 256
+	}
+
+	cx = new(big.Float).SetPrec(precisionBits).Set(cx)
+	cy = new(big.Float).SetPrec(precisionBits).Set(cy)
+	zx := new(big.Float).SetPrec(precisionBits)
+	zy := new(big.Float).SetPrec(precisionBits)
+	xx := new(big.Float).SetPrec(precisionBits)
+	yy := new(big.Float).SetPrec(precisionBits)
+	xy := new(big.Float).SetPrec(precisionBits)
+	modulus := new(big.Float).SetPrec(precisionBits)
+
+	orbit := referenceOrbit{centerFX: centerFX, centerFY: centerFY, escapedAt: maxIter, z: make([]complex128, 0, maxIter)}
+
+	for i := 0; i < maxIter; i++ {
+		zxf, _ := zx.Float64()
+		zyf, _ := zy.Float64()
+		orbit.z = append(orbit.z, complex(zxf, zyf))
+
+		xx.Mul(zx, zx)
+		yy.Mul(zy, zy)
+		xy.Mul(zx, zy)
+
+		if m, _ := modulus.Add(xx, yy).Float64(); m > 4 {
+			orbit.escapedAt = i
+			break
+		}
+
+		nextZx := new(big.Float).SetPrec(precisionBits).Sub(xx, yy)
+		nextZx.Add(nextZx, cx)
+		nextZy := new(big.Float).SetPrec(precisionBits).Add(xy, xy)
+		nextZy.Add(nextZy, cy)
+		zx, zy = nextZx, nextZy
+	}
+	return orbit
+}
+
+// perturbIterate computes the IterationResult for a pixel offset dc from
+// orbit's center (see refOrbitPool.dcFor) by iterating the delta dz against
+// the shared reference orbit (the Pauldelbrot perturbation technique):
+//
+//	dz_{n+1} = 2*Z_n*dz_n + dz_n^2 + dc
+//
+// z_n = Z_n + dz_n is tested for escape/glitch before dz is advanced to
+// dz_{n+1}, so every test runs against the pixel's actual orbit position
+// at iteration n rather than one step ahead of it.
+//
+// glitched reports the Pauldelbrot glitch-detection rule: the pixel has
+// diverged from the reference orbit (and should be rebased onto a nearer
+// one) once |Z_n + dz_n| < |dz_n| * glitchEpsilon, or once the reference
+// orbit itself ran out (it escaped before this pixel did, so there's
+// nothing left to compare against). The returned result never carries a
+// derivative modulus; distance-estimator coloring falls back to the escape
+// count for perturbation-rendered pixels.
+func perturbIterate(orbit referenceOrbit, dc complex128, maxIter int, glitchEpsilon float64) (res IterationResult, glitched bool) {
+	var dz, z complex128
+	refLen := len(orbit.z)
+
+	for i := 0; i < maxIter; i++ {
+		if i >= refLen {
+			return IterationResult{modulus: cmplxAbs2(z), iters: i, escaped: false}, true
+		}
+
+		zn := orbit.z[i]
+		z = zn + dz
+
+		if dz != 0 && cmplxAbs(z) < cmplxAbs(dz)*glitchEpsilon {
+			return IterationResult{modulus: cmplxAbs2(z), iters: i, escaped: false}, true
+		}
+		if cmplxAbs2(z) > 4 {
+			return IterationResult{modulus: cmplxAbs2(z), iters: i, escaped: true}, false
+		}
+
+		dz = 2*zn*dz + dz*dz + dc
+	}
+
+	return IterationResult{modulus: cmplxAbs2(z), iters: maxIter, escaped: false}, false
+}
+
+// refPrecisionBits returns cfg.refPointPrecision, defaulting to 256 bits
+// when unset.
+func refPrecisionBits(cfg *Config) uint {
+	if cfg.refPointPrecision <= 0 {
+		return 256
+	}
+	return uint(cfg.refPointPrecision)
+}
+
+// bigOrigin parses cfg's posX/posY at full precision from the original
+// request strings (cfg.posXRaw/posYRaw), falling back to the already-parsed
+// float64 value if the string is missing or malformed. float64 cfg.posX/
+// cfg.posY are rounded to ~15-17 significant digits at HTTP-parse time, far
+// short of what a deep zoom's absolute position needs.
+func bigOrigin(cfg *Config) (x, y *big.Float) {
+	prec := refPrecisionBits(cfg)
+	x = new(big.Float).SetPrec(prec)
+	if _, _, err := x.Parse(cfg.posXRaw, 10); err != nil {
+		x.SetFloat64(cfg.posX)
+	}
+	y = new(big.Float).SetPrec(prec)
+	if _, _, err := y.Parse(cfg.posYRaw, 10); err != nil {
+		y.SetFloat64(cfg.posY)
+	}
+	return x, y
+}
+
+// referenceCenter computes the high-precision absolute position for a
+// reference orbit seeded at pixel-grid coordinates (fx, fy), by adding a
+// float64-scale correction to the render's high-precision origin. This is
+// safe at any zoom depth because it's an addition of a small delta to an
+// already-precise base, not a subtraction of two absolute coordinates that
+// were each independently rounded to float64 first.
+func referenceCenter(cfg *Config, originRe, originIm *big.Float, fx, fy float64) (re, im *big.Float) {
+	prec := originRe.Prec()
+	dxRe := cfg.height * cfg.ratio * fx / float64(cfg.imgWidth)
+	dyIm := cfg.height * fy / float64(cfg.imgHeight)
+	re = new(big.Float).SetPrec(prec).Add(originRe, new(big.Float).SetPrec(prec).SetFloat64(dxRe))
+	im = new(big.Float).SetPrec(prec).Add(originIm, new(big.Float).SetPrec(prec).SetFloat64(dyIm))
+	return re, im
+}
+
+// refOrbitPool holds the small set of reference orbits computed so far for
+// one work block, each anchored via referenceCenter to the render's
+// high-precision origin. Pixels that glitch against every orbit already in
+// the pool are rebased onto a fresh orbit centered on themselves.
+type refOrbitPool struct {
+	cfg                *Config
+	originRe, originIm *big.Float
+	orbits             []referenceOrbit
+}
+
+// newRefOrbitPool seeds a pool with a single reference orbit centered on
+// pixel-grid coordinates (centerFX, centerFY), typically the work block's
+// midpoint.
+func newRefOrbitPool(cfg *Config, centerFX, centerFY float64) *refOrbitPool {
+	originRe, originIm := bigOrigin(cfg)
+	pool := &refOrbitPool{cfg: cfg, originRe: originRe, originIm: originIm}
+	re, im := referenceCenter(cfg, originRe, originIm, centerFX, centerFY)
+	pool.orbits = append(pool.orbits, computeReferenceOrbit(re, im, centerFX, centerFY, cfg.maxIter, refPrecisionBits(cfg)))
+	return pool
+}
+
+// dcFor returns the pixel-grid-scaled offset of pixel-grid coordinates
+// (fx, fy) from orbit's center. Both operands are bounded by the image's
+// pixel dimensions, so this float64 subtraction never suffers the
+// cancellation that subtracting two absolute complex-plane coordinates
+// would at deep zoom.
+func (p *refOrbitPool) dcFor(orbit referenceOrbit, fx, fy float64) complex128 {
+	dxRe := p.cfg.height * p.cfg.ratio * (fx - orbit.centerFX) / float64(p.cfg.imgWidth)
+	dyIm := p.cfg.height * (fy - orbit.centerFY) / float64(p.cfg.imgHeight)
+	return complex(dxRe, dyIm)
+}
+
+// iterate returns the IterationResult for pixel-grid coordinates (fx, fy),
+// trying the most recently added (and so most likely nearby) reference
+// orbit first and rebasing onto a new one centered on the pixel itself if
+// every existing orbit reports a glitch.
+func (p *refOrbitPool) iterate(fx, fy float64) IterationResult {
+	for i := len(p.orbits) - 1; i >= 0; i-- {
+		orbit := p.orbits[i]
+		res, glitched := perturbIterate(orbit, p.dcFor(orbit, fx, fy), p.cfg.maxIter, p.cfg.glitchEpsilon)
+		if !glitched {
+			return res
+		}
+	}
+
+	re, im := referenceCenter(p.cfg, p.originRe, p.originIm, fx, fy)
+	orbit := computeReferenceOrbit(re, im, fx, fy, p.cfg.maxIter, refPrecisionBits(p.cfg))
+	p.orbits = append(p.orbits, orbit)
+	res, _ := perturbIterate(orbit, 0, p.cfg.maxIter, p.cfg.glitchEpsilon)
+	return res
+}
+
+func cmplxAbs2(z complex128) float64 {
+	return real(z)*real(z) + imag(z)*imag(z)
+}
+
+func cmplxAbs(z complex128) float64 {
+	return math.Sqrt(cmplxAbs2(z))
+}
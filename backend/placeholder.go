@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// blurhashMinComponents and blurhashMaxComponents bound the x/yComponents
+// blurhash.Encode accepts; anything outside [1,9] panics rather than
+// returning an error, so callers must clamp before it gets that far.
+const (
+	blurhashMinComponents = 1
+	blurhashMaxComponents = 9
+)
+
+// encodeBlurhashPlaceholder reduces the rendered tile to a short ASCII
+// blurhash string, cheap enough to ship while the full tile is still
+// rendering elsewhere.
+func encodeBlurhashPlaceholder(pixels []byte, imgWidth, imgHeight, xComponents, yComponents int) ([]byte, string, error) {
+	img := rgbaFromPixels(pixels, imgWidth, imgHeight)
+
+	hash, err := blurhash.Encode(clampComponents(xComponents), clampComponents(yComponents), img)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(hash), "text/plain", nil
+}
+
+// clampComponents keeps a blurhash x/yComponents value within the [1,9]
+// range blurhash.Encode requires, so an out-of-range query param gets
+// clamped instead of panicking.
+func clampComponents(components int) int {
+	if components < blurhashMinComponents {
+		return blurhashMinComponents
+	}
+	if components > blurhashMaxComponents {
+		return blurhashMaxComponents
+	}
+	return components
+}
+
+// encodeThumbnail downsamples the tile so its longest side is maxDim pixels,
+// using Lanczos resampling, and returns it as a PNG. Front-ends can request
+// this while the full-resolution tile is still being computed.
+func encodeThumbnail(pixels []byte, imgWidth, imgHeight, maxDim int) ([]byte, string, error) {
+	img := rgbaFromPixels(pixels, imgWidth, imgHeight)
+
+	var thumb *image.NRGBA
+	if imgWidth >= imgHeight {
+		thumb = imaging.Resize(img, maxDim, 0, imaging.Lanczos)
+	} else {
+		thumb = imaging.Resize(img, 0, maxDim, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, thumb); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
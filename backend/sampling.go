@@ -0,0 +1,77 @@
+package main
+
+import "math"
+
+// sampleBatchSize is how many additional samples adaptiveSamplePixel draws
+// at a time once the pilot batch's variance says a pixel needs more.
+const sampleBatchSize = 4
+
+// adaptiveSamplePixel draws samples for pixel (x, y) until its color
+// variance settles, instead of always spending cfg.maxSamples. It starts
+// with a pilot batch of cfg.minSamples samples; if their variance exceeds
+// cfg.varianceEpsilon it keeps drawing in batches of sampleBatchSize up to
+// cfg.maxSamples, otherwise it stops early. This spends most of the sample
+// budget on chaotic boundary pixels while flat interior/exterior regions
+// resolve cheaply.
+func adaptiveSamplePixel(cfg *Config, palette Palette, perturb bool, pool *refOrbitPool, x, y int) (r, g, b uint8) {
+	var sumR, sumG, sumB float64
+	var sumR2, sumG2, sumB2 float64
+	n := 0
+
+	draw := func(count int) {
+		for i := 0; i < count; i++ {
+			fx := float64(x) + RandFloat64()
+			fy := float64(y) + RandFloat64()
+
+			var res IterationResult
+			if perturb {
+				// pool.iterate works entirely in pixel-grid coordinates, so
+				// it never has to subtract two absolute complex-plane
+				// coordinates (see perturb.go for why that matters at depth).
+				res = pool.iterate(fx, fy)
+			} else {
+				pa := cfg.height*cfg.ratio*(fx/float64(cfg.imgWidth)) + cfg.posX
+				pb := cfg.height*(fy/float64(cfg.imgHeight)) + cfg.posY
+				res = mandelbrotIteraction(pa, pb, cfg.maxIter)
+			}
+			c := palette.Color(colorValueFor(cfg.coloring, res, cfg.maxIter), cfg.maxIter)
+
+			fr, fg, fb := float64(c.R), float64(c.G), float64(c.B)
+			sumR += fr
+			sumG += fg
+			sumB += fb
+			sumR2 += fr * fr
+			sumG2 += fg * fg
+			sumB2 += fb * fb
+			n++
+		}
+	}
+
+	draw(cfg.minSamples)
+	for n < cfg.maxSamples && sampleVariance(sumR, sumR2, n, sumG, sumG2, sumB, sumB2) > cfg.varianceEpsilon {
+		batch := sampleBatchSize
+		if n+batch > cfg.maxSamples {
+			batch = cfg.maxSamples - n
+		}
+		draw(batch)
+	}
+
+	return uint8(sumR / float64(n)), uint8(sumG / float64(n)), uint8(sumB / float64(n))
+}
+
+// sampleVariance returns the largest of the three channels' running sample
+// variance, so one noisy channel is enough to keep a pixel sampling.
+func sampleVariance(sumR, sumR2 float64, n int, sumG, sumG2, sumB, sumB2 float64) float64 {
+	vr := channelVariance(sumR, sumR2, n)
+	vg := channelVariance(sumG, sumG2, n)
+	vb := channelVariance(sumB, sumB2, n)
+	return math.Max(vr, math.Max(vg, vb))
+}
+
+func channelVariance(sum, sumSq float64, n int) float64 {
+	if n < 2 {
+		return math.MaxFloat64
+	}
+	mean := sum / float64(n)
+	return sumSq/float64(n) - mean*mean
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// defaultTileSize is the side length, in pixels, of a slippy-map tile when
+// the caller doesn't specify one.
+const defaultTileSize = 256
+
+// TileConfig describes one slippy-map style tile addressed by z/x/y against
+// a caller-defined complex-plane bounding box rooted at (originX, originY)
+// with originHeight spanning the full box at zoom level 0.
+type TileConfig struct {
+	z            int
+	x            int
+	y            int
+	tileSize     int
+	originX      float64
+	originY      float64
+	originHeight float64
+	paletteID    string
+	format       string
+	quality      int
+	maxIter      int
+	coloring     string
+}
+
+// newTileConfigFromRequest parses the z/x/y/tileSize and origin bounding-box
+// parameters used by mode=tile requests, plus the rendering parameters that
+// tileETag hashes.
+func newTileConfigFromRequest(params map[string]string) TileConfig {
+	return TileConfig{
+		z:            getIntParam(params, "z", 0),
+		x:            getIntParam(params, "x", 0),
+		y:            getIntParam(params, "y", 0),
+		tileSize:     getIntParam(params, "tileSize", defaultTileSize),
+		originX:      getFloatParam(params, "posX", -2.0),
+		originY:      getFloatParam(params, "posY", -1.2),
+		originHeight: getFloatParam(params, "height", 2.5),
+		paletteID:    getStringParam(params, "palette", "default"),
+		format:       getStringParam(params, "format", "raw"),
+		quality:      getIntParam(params, "quality", 90),
+		maxIter:      getIntParam(params, "maxIter", 1000),
+		coloring:     getStringParam(params, "coloring", "escape"),
+	}
+}
+
+// tileToComplexRect maps a TileConfig's z/x/y tile coordinates to the
+// (posX, posY, height) window generateFractalBytes expects. Following the
+// classic slippy-map convention, zoom level z divides the origin bounding
+// box into 2^z tiles per side, with (x, y) selecting one of them.
+func tileToComplexRect(tc TileConfig) (posX, posY, height float64) {
+	divisions := float64(int64(1) << uint(tc.z))
+	height = tc.originHeight / divisions
+	posX = tc.originX + height*float64(tc.x)
+	posY = tc.originY + height*float64(tc.y)
+	return posX, posY, height
+}
+
+// tileETag builds a stable ETag for a tile from its addressing parameters
+// (z/x/y, tile size, origin box) and the palette name, format, quality,
+// maxIter and coloring mode, so CDNs (and browsers) can recognize identical
+// tiles across requests without re-rendering them. Other query parameters
+// (custom palette stops, sampling, perturbation, sentinel color and
+// placeholder settings) are not hashed, so tiles that differ only in those
+// share an ETag.
+func tileETag(tc TileConfig) string {
+	raw := fmt.Sprintf("%d/%d/%d:%d:%v:%v:%v:%s:%s:%d:%d:%s",
+		tc.z, tc.x, tc.y, tc.tileSize, tc.originX, tc.originY, tc.originHeight, tc.paletteID,
+		tc.format, tc.quality, tc.maxIter, tc.coloring)
+	sum := sha256.Sum256([]byte(raw))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
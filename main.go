@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"time"
 	"github.com/aws/aws-lambda-go/events"
@@ -13,12 +14,40 @@ import (
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	start := time.Now()
 
+	params := request.QueryStringParameters
+	headers := map[string]string{}
+
+	// mode=tile addresses a fixed-size slippy-map tile by z/x/y instead of
+	// an explicit posX/posY/height window, and is cacheable by ETag.
+	if params["mode"] == "tile" {
+		params = cloneParams(params)
+		if _, ok := params["format"]; !ok {
+			params["format"] = "png"
+		}
+
+		tc := newTileConfigFromRequest(params)
+		etag := tileETag(tc)
+		if request.Headers["If-None-Match"] == etag {
+			return events.APIGatewayProxyResponse{StatusCode: 304, Headers: map[string]string{"ETag": etag}}, nil
+		}
+		headers["ETag"] = etag
+
+		posX, posY, height := tileToComplexRect(tc)
+		params["posX"] = fmt.Sprintf("%v", posX)
+		params["posY"] = fmt.Sprintf("%v", posY)
+		params["height"] = fmt.Sprintf("%v", height)
+		params["width"] = fmt.Sprintf("%d", tc.tileSize)
+		params["height_px"] = fmt.Sprintf("%d", tc.tileSize)
+	}
+
 	// Parse parameters from the Lambda event's query string.
-	cfg := newConfigFromRequest(request.QueryStringParameters)
+	cfg := newConfigFromRequest(params)
 	log.Printf("Handling request with config: %+v", cfg)
 
-	// Generate the raw pixel data.
-	pixelBytes, err := generateFractalBytes(cfg)
+	// Generate the image, encoded in whatever format the caller asked for.
+	// If the Lambda deadline is close, this returns early with complete set
+	// to false rather than racing the container getting killed.
+	pixelBytes, contentType, complete, err := generateFractalBytes(ctx, cfg)
 	if err != nil {
 		log.Printf("Error generating fractal: %v", err)
 		return events.APIGatewayProxyResponse{StatusCode: 500}, err
@@ -28,17 +57,29 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	// and the IsBase64Encoded flag to be set to true.
 	encodedBody := base64.StdEncoding.EncodeToString(pixelBytes)
 
-	log.Printf("Finished generation in %v. Sending %d bytes.", time.Since(start), len(pixelBytes))
+	log.Printf("Finished generation in %v. Sending %d bytes as %s (complete: %v).", time.Since(start), len(pixelBytes), contentType, complete)
 
 	// Return the response.
+	headers["Content-Type"] = contentType
+	headers["X-Fractal-Complete"] = fmt.Sprintf("%v", complete)
 	return events.APIGatewayProxyResponse{
 		StatusCode:      200,
-		Headers:         map[string]string{"Content-Type": "application/octet-stream"},
+		Headers:         headers,
 		Body:            encodedBody,
 		IsBase64Encoded: true,
 	}, nil
 }
 
+// cloneParams copies a query-parameter map so tile requests can override
+// posX/posY/height/width without mutating the Lambda event's original map.
+func cloneParams(params map[string]string) map[string]string {
+	cloned := make(map[string]string, len(params)+4)
+	for k, v := range params {
+		cloned[k] = v
+	}
+	return cloned
+}
+
 func main() {
 	// This is the magic that connects our handler to the Lambda runtime.
 	lambda.Start(handler)